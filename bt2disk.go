@@ -3,18 +3,56 @@ package bt2disk
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
 	"hash/fnv"
 	"log"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/bigtable"
-	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// schemaTable holds the column-family/GC-policy metadata captured alongside the per-table cell
+// data, so that Restore can recreate tables from scratch instead of assuming they already exist.
+const schemaTable = "_bt2disk_schema"
+
+// familySchema is the saved shape of a single column family within a table.
+type familySchema struct {
+	Name     string
+	GCPolicy string // empty means "no GC policy was set"
+}
+
+// Options tunes the concurrency and batching used by Save/Restore and their per-table
+// counterparts. The zero value is fully sequential, matching bt2disk's original behavior.
+type Options struct {
+	// ParallelTables is how many tables to process at once. Defaults to 1.
+	ParallelTables int
+	// ParallelBatches is how many ApplyBulk batches RestoreTable keeps in flight per table at
+	// once. Defaults to 1.
+	ParallelBatches int
+	// BatchSize is how many cells RestoreTable collects before flushing a batch. Defaults to 100.
+	BatchSize int
+}
+
+// withDefaults returns o with every unset (<=0) field replaced by its default.
+func (o Options) withDefaults() Options {
+	if o.ParallelTables <= 0 {
+		o.ParallelTables = 1
+	}
+	if o.ParallelBatches <= 0 {
+		o.ParallelBatches = 1
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 100
+	}
+	return o
+}
+
 func filterErrors(errs []error) []error {
 	var out []error
 	for _, err := range errs {
@@ -25,107 +63,161 @@ func filterErrors(errs []error) []error {
 	return out
 }
 
-func Restore(ctx context.Context, db *sql.DB, adminClient *bigtable.AdminClient, btClient *bigtable.Client) error {
-	tables, err := adminClient.Tables(ctx)
+func Restore(ctx context.Context, store Store, adminClient *bigtable.AdminClient, btClient *bigtable.Client, opts Options) error {
+	opts = opts.withDefaults()
+
+	schemas, err := store.GetSchema()
 	if err != nil {
-		return fmt.Errorf("failed to list BT tables: %s", err)
+		return fmt.Errorf("failed to load saved schema: %s", err)
 	}
 
-	sort.Strings(tables)
+	tables, err := store.ListTables()
+	if err != nil {
+		return fmt.Errorf("failed to list saved tables: %s", err)
+	}
 
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(opts.ParallelTables)
 	for _, table := range tables {
-		if err := adminClient.DropAllRows(ctx, table); err != nil {
-			return fmt.Errorf("failed to delete table %q", table)
-		}
+		table := table
+		g.Go(func() error {
+			if err := restoreSchema(ctx, adminClient, table, schemas[table], true); err != nil {
+				return fmt.Errorf("failed to restore schema for %q: %s", table, err)
+			}
+			if err := RestoreTable(ctx, table, store, btClient, opts); err != nil {
+				return fmt.Errorf("failed to restore table %q: %s", table, err)
+			}
+			return nil
+		})
 	}
+	return g.Wait()
+}
 
-	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%'`)
-	if err != nil {
-		return fmt.Errorf("failed to query sqlite for list of tables")
+// restoreSchema makes sure table exists with the given column families and GC policies,
+// creating or updating whatever is missing. clearRows should be true when restoring a full
+// snapshot, so any rows left over from a prior life of the table are cleared before the bulk
+// apply that follows; an incremental snapshot restoring on top of an already-restored table
+// passes false so it doesn't wipe out the data that incremental snapshot builds on.
+func restoreSchema(ctx context.Context, adminClient *bigtable.AdminClient, table string, families []familySchema, clearRows bool) error {
+	if err := adminClient.CreateTable(ctx, table); err != nil && status.Code(err) != codes.AlreadyExists {
+		return fmt.Errorf("failed to create table: %s", err)
 	}
 
-	for rows.Next() {
-		var table string
-		if err := rows.Scan(&table); err != nil {
-			return fmt.Errorf("failed to scan table-list results: %s", err)
+	for _, f := range families {
+		if err := adminClient.CreateColumnFamily(ctx, table, f.Name); err != nil && status.Code(err) != codes.AlreadyExists {
+			return fmt.Errorf("failed to create column family %q: %s", f.Name, err)
 		}
 
-		if err := RestoreTable(ctx, table, db, btClient); err != nil {
-			return fmt.Errorf("failed to restore table %q: %s", table, err)
+		// "<never>" is GCRuleToString's spelling of "no GC policy was set", same as the empty
+		// string we'd get from an older snapshot that predates FamilyInfo.GCPolicy round-tripping
+		// through that function.
+		if f.GCPolicy == "" || f.GCPolicy == "<never>" {
+			continue
 		}
+
+		policy, err := parseGCPolicy(f.GCPolicy)
+		if err != nil {
+			return fmt.Errorf("failed to parse saved GC policy %q for family %q: %s", f.GCPolicy, f.Name, err)
+		}
+		if err := adminClient.SetGCPolicy(ctx, table, f.Name, policy); err != nil {
+			return fmt.Errorf("failed to set GC policy for family %q: %s", f.Name, err)
+		}
+	}
+
+	if !clearRows {
+		return nil
+	}
+	if err := adminClient.DropAllRows(ctx, table); err != nil {
+		return fmt.Errorf("failed to delete existing rows from %q", table)
 	}
 	return nil
 }
 
-func RestoreTable(ctx context.Context, table string, db *sql.DB, btClient *bigtable.Client) error {
+func RestoreTable(ctx context.Context, table string, store Store, btClient *bigtable.Client, opts Options) error {
+	opts = opts.withDefaults()
 	log.Printf("restoring %q table...", table)
 
 	tbl := btClient.Open(table)
 
-	rows, err := db.Query(`SELECT key, column_family, column, value, timestamp, chk FROM "` + table + `"`)
+	cells, err := store.ReadCells(table)
 	if err != nil {
-		return fmt.Errorf("failed to query table contents: %s", err)
+		return fmt.Errorf("failed to read saved cells: %s", err)
+	}
+	defer cells.Close()
+
+	integ := newTableIntegrity()
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(opts.ParallelBatches)
+	flush := func(keys []string, muts []*bigtable.Mutation) {
+		g.Go(func() error {
+			if errs, err := tbl.ApplyBulk(ctx, keys, muts); err != nil {
+				return fmt.Errorf("failed to write to bigtable: %s", err)
+			} else if errs = filterErrors(errs); len(errs) > 0 {
+				return fmt.Errorf("failed to write to bigtable, %d errors, first: %s", len(errs), errs[0])
+			}
+			return nil
+		})
 	}
 
 	var c int
 	var keys []string
 	var muts []*bigtable.Mutation
 
-	for rows.Next() {
-		var key, cf, col string
-		var value []byte
-		var ts int64
-		var chk uint32
-		if err := rows.Scan(&key, &cf, &col, &value, &ts, &chk); err != nil {
-			return fmt.Errorf("failed to scan table-list results: %s", err)
-		}
-
-		timestamp := time.Unix(0, ts)
+	for cells.Next() {
+		cell := cells.Cell()
+		timestamp := time.Unix(0, cell.Timestamp)
 
 		hasher := fnv.New32a()
-		_, _ = fmt.Fprintf(hasher, key)
-		_, _ = fmt.Fprintf(hasher, cf)
-		_, _ = fmt.Fprintf(hasher, col)
-		_, _ = hasher.Write(value)
+		_, _ = fmt.Fprintf(hasher, cell.Key)
+		_, _ = fmt.Fprintf(hasher, cell.Family)
+		_, _ = fmt.Fprintf(hasher, cell.Column)
+		_, _ = hasher.Write(cell.Value)
 		_, _ = fmt.Fprintf(hasher, timestamp.Format(time.RFC3339Nano))
 
-		if computed := hasher.Sum32(); chk != computed {
-			return fmt.Errorf("integrity check failed, db.chk=%d, computed hash = %d", chk, computed)
+		if computed := hasher.Sum32(); cell.Checksum != computed {
+			return fmt.Errorf("integrity check failed, saved chk=%d, computed hash = %d", cell.Checksum, computed)
 		}
+		integ.add(cell)
 
 		m := bigtable.NewMutation()
-		m.Set(cf, col, bigtable.Time(timestamp), value)
+		m.Set(cell.Family, cell.Column, bigtable.Time(timestamp), cell.Value)
 
 		c++
-		keys = append(keys, key)
+		keys = append(keys, cell.Key)
 		muts = append(muts, m)
 
-		// nothing magic about 100, tune as necessary - we just need some limit so that grpc payloads don't get too huge
-		if len(muts) == 100 {
-			if errs, err := tbl.ApplyBulk(ctx, keys, muts); err != nil {
-				return fmt.Errorf("failed to write to bigtable: %s", err)
-			} else if errs = filterErrors(errs); len(errs) > 0 {
-				return fmt.Errorf("failed to write to bigtable, %d errors, first: %s", len(errs), errs[0])
-			}
-
+		// batch size is caller-tunable via Options - we just need some limit so that grpc
+		// payloads don't get too huge
+		if len(muts) == opts.BatchSize {
+			flush(keys, muts)
 			keys = nil
 			muts = nil
 		}
 	}
+	if err := cells.Err(); err != nil {
+		return fmt.Errorf("failed to read saved cells: %s", err)
+	}
 
 	if len(muts) > 0 {
-		if errs, err := tbl.ApplyBulk(ctx, keys, muts); err != nil {
-			return fmt.Errorf("failed to write to bigtable: %s", err)
-		} else if errs = filterErrors(errs); len(errs) > 0 {
-			return fmt.Errorf("failed to write to bigtable, %d errors, first: %s", len(errs), errs[0])
-		}
+		flush(keys, muts)
+	}
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	if err := verifyIntegrity(store, table, integ); err != nil {
+		return err
 	}
 
 	log.Printf("restored %d rows for %s", c, table)
 	return nil
 }
 
-func SaveAll(ctx context.Context, db *sql.DB, adminClient *bigtable.AdminClient, btClient *bigtable.Client) error {
+func SaveAll(ctx context.Context, store Store, adminClient *bigtable.AdminClient, btClient *bigtable.Client, opts Options) error {
+	opts = opts.withDefaults()
+
 	tables, err := adminClient.Tables(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to list BT tables: %s", err)
@@ -133,58 +225,76 @@ func SaveAll(ctx context.Context, db *sql.DB, adminClient *bigtable.AdminClient,
 
 	sort.Strings(tables)
 
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(opts.ParallelTables)
 	for _, table := range tables {
-		if err := SaveTable(ctx, table, db, btClient); err != nil {
-			return fmt.Errorf("failed to save table %q: %s", table, err)
-		}
+		table := table
+		g.Go(func() error {
+			if err := saveSchema(ctx, adminClient, table, store); err != nil {
+				return fmt.Errorf("failed to save schema for %q: %s", table, err)
+			}
+			if err := SaveTable(ctx, table, store, btClient); err != nil {
+				return fmt.Errorf("failed to save table %q: %s", table, err)
+			}
+			return nil
+		})
 	}
-
-	return nil
+	return g.Wait()
 }
 
-func SaveTable(ctx context.Context, table string, db *sql.DB, btClient *bigtable.Client) error {
-	log.Printf("saving %q table...", table)
-	stmt, err := db.Prepare(`DROP TABLE IF EXISTS "` + table + `"`)
+// saveSchema records table's column families and their GC policies in store.
+func saveSchema(ctx context.Context, adminClient *bigtable.AdminClient, table string, store Store) error {
+	info, err := adminClient.TableInfo(ctx, table)
 	if err != nil {
-		return fmt.Errorf("failed to prepare DROP TABLE: %s", err)
-	}
-	if _, err := stmt.Exec(); err != nil {
-		return fmt.Errorf("failed to execute DROP TABLE: %s", err)
+		return fmt.Errorf("failed to fetch table info: %s", err)
 	}
 
-	stmt, err = db.Prepare(`CREATE TABLE IF NOT EXISTS "` + table + `" (key TEXT, column_family TEXT, column TEXT, value BLOB, timestamp INTEGER, chk INTEGER)`)
-	if err != nil {
-		return fmt.Errorf("failed to prepare CREATE TABLE: %s", err)
-	}
-	if _, err := stmt.Exec(); err != nil {
-		return fmt.Errorf("failed to execute CREATE TABLE: %s", err)
+	families := make([]familySchema, len(info.FamilyInfos))
+	for i, fi := range info.FamilyInfos {
+		families[i] = familySchema{Name: fi.Name, GCPolicy: fi.GCPolicy}
 	}
 
-	insertStmt, err := db.Prepare(`INSERT INTO "` + table + `" VALUES (?, ?, ?, ?, ?, ?)`)
-	if err != nil {
-		return fmt.Errorf("failed to prepare INSERT: %s", err)
+	return store.PutSchema(table, families)
+}
+
+func SaveTable(ctx context.Context, table string, store Store, btClient *bigtable.Client) error {
+	log.Printf("saving %q table...", table)
+
+	if err := store.BeginTable(table); err != nil {
+		return fmt.Errorf("failed to prepare destination for %q: %s", table, err)
 	}
 
 	var c int
 	var rowErr error
+	integ := newTableIntegrity()
 	tbl := btClient.Open(table)
-	err = tbl.ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+	err := tbl.ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
 		for cf, items := range row {
 			for _, item := range items {
 				// tricky!  the item.Column that we get back is prefixed with the column family
 				col := strings.TrimPrefix(item.Column, cf+":")
+				timestamp := item.Timestamp.Time()
 
 				hasher := fnv.New32a()
 				_, _ = fmt.Fprintf(hasher, item.Row)
 				_, _ = fmt.Fprintf(hasher, cf)
 				_, _ = fmt.Fprintf(hasher, col)
 				_, _ = hasher.Write(item.Value)
-				_, _ = fmt.Fprintf(hasher, item.Timestamp.Time().Format(time.RFC3339Nano))
-
-				if _, err := insertStmt.Exec(item.Row, cf, col, item.Value, item.Timestamp.Time().UnixNano(), hasher.Sum32()); err != nil {
+				_, _ = fmt.Fprintf(hasher, timestamp.Format(time.RFC3339Nano))
+
+				cell := Cell{
+					Key:       item.Row,
+					Family:    cf,
+					Column:    col,
+					Value:     item.Value,
+					Timestamp: timestamp.UnixNano(),
+					Checksum:  hasher.Sum32(),
+				}
+				if err := store.WriteCell(table, cell); err != nil {
 					rowErr = fmt.Errorf("failed to save row %s: %s", row.Key(), err)
 					return false
 				}
+				integ.add(cell)
 				c++
 			}
 		}
@@ -197,6 +307,138 @@ func SaveTable(ctx context.Context, table string, db *sql.DB, btClient *bigtable
 		return rowErr
 	}
 
+	if err := store.PutIntegrity(table, integ.root(), integ.count()); err != nil {
+		return fmt.Errorf("failed to save integrity metadata for %q: %s", table, err)
+	}
+
 	log.Printf("saved %d rows for %s", c, table)
 	return nil
 }
+
+// parseGCPolicy parses the GC policy text reported by bigtable.FamilyInfo.GCPolicy - which is
+// bigtable.GCRuleToString's output, e.g. "versions() > 3", "age() > 1d", or a combination like
+// "(versions() > 3 && age() > 1h && versions() > 1)" - back into a bigtable.GCPolicy that can be
+// passed to AdminClient.SetGCPolicy. It understands the two leaf forms and any number of children
+// combined with a single operator, each of which may itself be a nested combination. Callers
+// should treat GCRuleToString's "<never>" (no policy set) separately - this function doesn't
+// accept it.
+func parseGCPolicy(s string) (bigtable.GCPolicy, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		inner := s[1 : len(s)-1]
+
+		var sep string
+		switch {
+		case containsTopLevel(inner, " && "):
+			sep = " && "
+		case containsTopLevel(inner, " || "):
+			sep = " || "
+		default:
+			return nil, fmt.Errorf("unrecognized combined GC policy: %q", s)
+		}
+
+		parts := splitTopLevel(inner, sep)
+		children := make([]bigtable.GCPolicy, len(parts))
+		for i, part := range parts {
+			child, err := parseGCPolicy(part)
+			if err != nil {
+				return nil, err
+			}
+			children[i] = child
+		}
+
+		if sep == " && " {
+			return bigtable.IntersectionPolicy(children...), nil
+		}
+		return bigtable.UnionPolicy(children...), nil
+	}
+
+	if rest := strings.TrimPrefix(s, "versions() > "); rest != s {
+		var n int
+		if _, err := fmt.Sscanf(rest, "%d", &n); err != nil {
+			return nil, fmt.Errorf("invalid version count %q: %s", rest, err)
+		}
+		return bigtable.MaxVersionsPolicy(n), nil
+	}
+
+	if rest := strings.TrimPrefix(s, "age() > "); rest != s {
+		d, err := parseGCDuration(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age duration %q: %s", rest, err)
+		}
+		return bigtable.MaxAgePolicy(d), nil
+	}
+
+	return nil, fmt.Errorf("unrecognized GC policy: %q", s)
+}
+
+// containsTopLevel reports whether sep occurs in s outside of any parenthesized child, so a
+// nested combination like "(a && b) || c" isn't mistaken for one joined by "&&".
+func containsTopLevel(s, sep string) bool {
+	depth := 0
+	for i := 0; i+len(sep) <= len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+		if depth == 0 && s[i:i+len(sep)] == sep {
+			return true
+		}
+	}
+	return false
+}
+
+// splitTopLevel splits s on every occurrence of sep that's outside of a parenthesized child,
+// mirroring containsTopLevel, so each returned part is one child of an N-way combination.
+func splitTopLevel(s, sep string) []string {
+	var parts []string
+	depth := 0
+	start := 0
+	for i := 0; i+len(sep) <= len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+		if depth == 0 && s[i:i+len(sep)] == sep {
+			parts = append(parts, s[start:i])
+			start = i + len(sep)
+			i += len(sep) - 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseGCDuration parses the duration strings bigtable.MaxAgeGCPolicy.String emits for an
+// "age() > ..." GC policy: a whole number of days/hours/minutes suffixed with "d"/"h"/"m", or -
+// when the duration isn't a whole number of any of those - a bare number of microseconds. None of
+// this is time.ParseDuration's format ("1d" isn't valid Go duration syntax).
+func parseGCDuration(s string) (time.Duration, error) {
+	units := []struct {
+		suffix string
+		unit   time.Duration
+	}{
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+	}
+	for _, u := range units {
+		if rest := strings.TrimSuffix(s, u.suffix); rest != s {
+			n, err := strconv.ParseInt(rest, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q: %s", s, err)
+			}
+			return time.Duration(n) * u.unit, nil
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("not a recognized bigtable duration: %q", s)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
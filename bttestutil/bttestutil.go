@@ -0,0 +1,185 @@
+// Package bttestutil wires an in-process BigTable emulator (cloud.google.com/go/bigtable/bttest)
+// to a bigtable.AdminClient and bigtable.Client, plus an in-memory SQLite database, so bt2disk's
+// save/restore path can be exercised from `go test` without a separately-running emulator
+// binary.
+package bttestutil
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"cloud.google.com/go/bigtable/bttest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const project = "bttestutil-project"
+const instance = "bttestutil-instance"
+
+// Harness bundles the in-process BigTable emulator's clients with an in-memory SQLite database.
+type Harness struct {
+	Admin  *bigtable.AdminClient
+	Client *bigtable.Client
+	DB     *sql.DB
+
+	srv  *bttest.Server
+	conn *grpc.ClientConn
+}
+
+// New starts an in-process BigTable emulator and opens an in-memory SQLite database, registering
+// t.Cleanup to tear both down when the test finishes.
+func New(t testing.TB) *Harness {
+	t.Helper()
+
+	srv, err := bttest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatalf("failed to start bttest server: %s", err)
+	}
+
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		srv.Close()
+		t.Fatalf("failed to dial bttest server: %s", err)
+	}
+
+	ctx := context.Background()
+	admin, err := bigtable.NewAdminClient(ctx, project, instance, option.WithGRPCConn(conn))
+	if err != nil {
+		_ = conn.Close()
+		srv.Close()
+		t.Fatalf("failed to create admin client: %s", err)
+	}
+	client, err := bigtable.NewClient(ctx, project, instance, option.WithGRPCConn(conn))
+	if err != nil {
+		_ = admin.Close()
+		_ = conn.Close()
+		srv.Close()
+		t.Fatalf("failed to create bigtable client: %s", err)
+	}
+
+	// cache=shared keeps the in-memory database alive across connections for the life of the
+	// process, rather than wiping it out between queries.
+	db, err := sql.Open("sqlite3", "file::memory:?cache=shared")
+	if err != nil {
+		_ = client.Close()
+		_ = admin.Close()
+		_ = conn.Close()
+		srv.Close()
+		t.Fatalf("failed to open in-memory sqlite db: %s", err)
+	}
+
+	h := &Harness{Admin: admin, Client: client, DB: db, srv: srv, conn: conn}
+	t.Cleanup(h.Close)
+	return h
+}
+
+// Close tears down the harness's resources. New registers this with t.Cleanup, so tests don't
+// normally need to call it directly.
+func (h *Harness) Close() {
+	_ = h.DB.Close()
+	_ = h.Client.Close()
+	_ = h.Admin.Close()
+	_ = h.conn.Close()
+	h.srv.Close()
+}
+
+// RowCell is a single cell to seed via SeedTable.
+type RowCell struct {
+	Family    string
+	Column    string
+	Value     []byte
+	Timestamp bigtable.Timestamp
+}
+
+// Row is a single row to seed via SeedTable.
+type Row struct {
+	Key   string
+	Cells []RowCell
+}
+
+// SeedTable creates table with families (no GC policy is set; tests that care about one should
+// call admin.SetGCPolicy themselves) and writes rows into it.
+func SeedTable(t testing.TB, admin *bigtable.AdminClient, client *bigtable.Client, table string, families []string, rows []Row) {
+	t.Helper()
+	ctx := context.Background()
+
+	if err := admin.CreateTable(ctx, table); err != nil {
+		t.Fatalf("failed to create table %q: %s", table, err)
+	}
+	for _, f := range families {
+		if err := admin.CreateColumnFamily(ctx, table, f); err != nil {
+			t.Fatalf("failed to create column family %q on %q: %s", f, table, err)
+		}
+	}
+
+	tbl := client.Open(table)
+	for _, row := range rows {
+		mut := bigtable.NewMutation()
+		for _, cell := range row.Cells {
+			mut.Set(cell.Family, cell.Column, cell.Timestamp, cell.Value)
+		}
+		if err := tbl.Apply(ctx, row.Key, mut); err != nil {
+			t.Fatalf("failed to write row %q to %q: %s", row.Key, table, err)
+		}
+	}
+}
+
+// cellKey identifies a single versioned cell within a row, for comparison purposes.
+type cellKey struct {
+	Family    string
+	Column    string
+	Timestamp bigtable.Timestamp
+}
+
+// AssertTablesEqual fails t unless tableA and tableB hold exactly the same rows, cells, and cell
+// versions (values and timestamps included).
+func AssertTablesEqual(t testing.TB, client *bigtable.Client, tableA, tableB string) {
+	t.Helper()
+
+	a := dumpTable(t, client, tableA)
+	b := dumpTable(t, client, tableB)
+
+	for key, cellsA := range a {
+		cellsB, ok := b[key]
+		if !ok {
+			t.Errorf("row %q present in %q but missing from %q", key, tableA, tableB)
+			continue
+		}
+		if !reflect.DeepEqual(cellsA, cellsB) {
+			t.Errorf("row %q differs between %q and %q:\n got:  %+v\n want: %+v", key, tableA, tableB, cellsA, cellsB)
+		}
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			t.Errorf("row %q present in %q but missing from %q", key, tableB, tableA)
+		}
+	}
+}
+
+func dumpTable(t testing.TB, client *bigtable.Client, table string) map[string]map[cellKey]string {
+	t.Helper()
+
+	tbl := client.Open(table)
+	out := make(map[string]map[cellKey]string)
+	err := tbl.ReadRows(context.Background(), bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		cells := make(map[cellKey]string)
+		for cf, items := range row {
+			for _, item := range items {
+				col := strings.TrimPrefix(item.Column, cf+":")
+				cells[cellKey{Family: cf, Column: col, Timestamp: item.Timestamp}] = string(item.Value)
+			}
+		}
+		out[row.Key()] = cells
+		return true
+	})
+	if err != nil {
+		t.Fatalf("failed to read table %q: %s", table, err)
+	}
+	return out
+}
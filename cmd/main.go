@@ -4,21 +4,26 @@ package main
 import (
 	"cloud.google.com/go/bigtable"
 	"context"
-	"database/sql"
 	"flag"
 	"fmt"
 	"github.com/fullstorydev/bt2disk"
-	_ "github.com/mattn/go-sqlite3"
 	"log"
 	"os"
 	"strings"
 )
 
 func main() {
-	db := flag.String("db", "", "Target sqlite file to save to or restore from")
+	db := flag.String("db", "", "Target sqlite file to save to or restore from (backend=sqlite only)")
+	backend := flag.String("backend", "sqlite", "Storage backend to use: 'sqlite' or 'postgres'")
+	dsn := flag.String("dsn", "", "Data source name for the storage backend (backend=postgres; defaults to -db for backend=sqlite)")
+	target := flag.String("target", "", "Object-store target for a chunked snapshot (gs://bucket/prefix, s3://bucket/prefix, or a local directory); when set, -backend/-dsn/-db are ignored")
+	parent := flag.String("parent", "", "Prior snapshot's -target to save incrementally against; requires -target (restore ignores it and follows the parent recorded in the snapshot's manifest)")
 	project := flag.String("project", "local", "GCP project to connect to")
 	instance := flag.String("instance", "local", "BigTable instance to connect to")
 	gcp := flag.Bool("gcp", false, "Set to 'true' to connect to real GCP instances (safeguard)")
+	parallelTables := flag.Int("parallel-tables", 1, "Number of tables to save/restore concurrently (backend=sqlite/postgres only)")
+	parallelBatches := flag.Int("parallel-batches", 1, "Number of ApplyBulk batches to have in flight per table while restoring (backend=sqlite/postgres only)")
+	batchSize := flag.Int("batch-size", 100, "Number of cells per ApplyBulk batch while restoring (backend=sqlite/postgres only)")
 
 	flag.Usage = func() {
 		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Usage:  bt2disk [-d DIR] restore|save\n")
@@ -37,6 +42,9 @@ func main() {
 	if *db == "" {
 		*db = *instance + ".db"
 	}
+	if *dsn == "" {
+		*dsn = *db
+	}
 
 	args := flag.Args()
 	switch len(args) {
@@ -60,18 +68,54 @@ func main() {
 		log.Fatalf("failed to connect to bigtable instance: %s", err)
 	}
 
-	dbClient, err := sql.Open("sqlite3", *db)
+	if *parent != "" && *target == "" {
+		_, _ = fmt.Fprintf(os.Stderr, "bt2disk: -parent requires -target\n")
+		os.Exit(2)
+	}
+
+	if *target != "" {
+		switch strings.ToLower(args[0]) {
+		case "restore":
+			// RestoreIncremental follows Manifest.Parent itself, so it also handles a plain,
+			// non-incremental snapshot (a chain of one).
+			if err := bt2disk.RestoreIncremental(ctx, *target, adminClient, btClient); err != nil {
+				log.Fatalf("failed to restore: %s", err)
+			}
+		case "save":
+			var err error
+			if *parent != "" {
+				err = bt2disk.SaveIncremental(ctx, *target, *parent, adminClient, btClient)
+			} else {
+				err = bt2disk.SaveObjectSnapshot(ctx, *target, adminClient, btClient)
+			}
+			if err != nil {
+				log.Fatalf("failed to save: %s", err)
+			}
+		default:
+			_, _ = fmt.Fprintf(os.Stderr, "bt2disk: unrecognized action: %q\n", args[0])
+			os.Exit(2)
+		}
+		return
+	}
+
+	store, err := openStore(*backend, *dsn)
 	if err != nil {
-		log.Fatalf("failed to open %q: %s", *db, err)
+		log.Fatalf("failed to open %q backend: %s", *backend, err)
+	}
+
+	opts := bt2disk.Options{
+		ParallelTables:  *parallelTables,
+		ParallelBatches: *parallelBatches,
+		BatchSize:       *batchSize,
 	}
 
 	switch strings.ToLower(args[0]) {
 	case "restore":
-		if err := bt2disk.Restore(ctx, dbClient, adminClient, btClient); err != nil {
+		if err := bt2disk.Restore(ctx, store, adminClient, btClient, opts); err != nil {
 			log.Fatalf("failed to restore: %s", err)
 		}
 	case "save":
-		if err := bt2disk.SaveAll(ctx, dbClient, adminClient, btClient); err != nil {
+		if err := bt2disk.SaveAll(ctx, store, adminClient, btClient, opts); err != nil {
 			log.Fatalf("failed to save: %s", err)
 		}
 	default:
@@ -79,7 +123,19 @@ func main() {
 		os.Exit(2)
 	}
 
-	if err := dbClient.Close(); err != nil {
-		log.Fatalf("failed to close database: %s", err)
+	if err := store.Close(); err != nil {
+		log.Fatalf("failed to close store: %s", err)
+	}
+}
+
+// openStore opens the storage backend named by backend, using dsn to locate it.
+func openStore(backend, dsn string) (bt2disk.Store, error) {
+	switch strings.ToLower(backend) {
+	case "sqlite":
+		return bt2disk.OpenSQLiteStore(dsn)
+	case "postgres":
+		return bt2disk.OpenPostgresStore(dsn)
+	default:
+		return nil, fmt.Errorf("unrecognized backend %q, want 'sqlite' or 'postgres'", backend)
 	}
 }
@@ -0,0 +1,42 @@
+package bt2disk
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+)
+
+// gcsObjectStore stores blobs as objects in a single GCS bucket.
+type gcsObjectStore struct {
+	bucket *storage.BucketHandle
+}
+
+func newGCSObjectStore(ctx context.Context, bucket string) (*gcsObjectStore, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS client: %s", err)
+	}
+	return &gcsObjectStore{bucket: client.Bucket(bucket)}, nil
+}
+
+func (s *gcsObjectStore) Put(ctx context.Context, key string, r io.Reader) error {
+	w := s.bucket.Object(key).NewWriter(ctx)
+	if _, err := io.Copy(w, r); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("failed to upload %q: %s", key, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to finalize upload of %q: %s", key, err)
+	}
+	return nil
+}
+
+func (s *gcsObjectStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	r, err := s.bucket.Object(key).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %q: %s", key, err)
+	}
+	return r, nil
+}
@@ -0,0 +1,235 @@
+package bt2disk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+)
+
+// SaveIncremental writes the cells of every BigTable table that changed since parentTarget's
+// snapshot was taken into a new chunked snapshot at target, using BigTable's own cell
+// timestamps as the watermark: only cells at or after the parent manifest's Until are read. Rows
+// that were present as of the parent snapshot but are no longer observed in BigTable are
+// recorded as tombstones, so RestoreIncremental can mirror their deletion.
+func SaveIncremental(ctx context.Context, target, parentTarget string, adminClient *bigtable.AdminClient, btClient *bigtable.Client) error {
+	parentStore, parentPrefix, err := OpenObjectStore(ctx, parentTarget)
+	if err != nil {
+		return fmt.Errorf("failed to open parent snapshot: %s", err)
+	}
+	parentManifest, err := readManifest(ctx, parentStore, parentPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to read parent manifest: %s", err)
+	}
+
+	since := time.Unix(0, parentManifest.Until)
+	until := time.Now()
+
+	store, prefix, err := OpenObjectStore(ctx, target)
+	if err != nil {
+		return fmt.Errorf("failed to open object store: %s", err)
+	}
+
+	tables, err := adminClient.Tables(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list BT tables: %s", err)
+	}
+	sort.Strings(tables)
+
+	manifest := Manifest{Parent: parentTarget, Since: since.UnixNano(), Until: until.UnixNano()}
+	for _, table := range tables {
+		info, err := adminClient.TableInfo(ctx, table)
+		if err != nil {
+			return fmt.Errorf("failed to fetch table info for %q: %s", table, err)
+		}
+		families := make([]familySchema, len(info.FamilyInfos))
+		for i, fi := range info.FamilyInfos {
+			families[i] = familySchema{Name: fi.Name, GCPolicy: fi.GCPolicy}
+		}
+
+		log.Printf("saving changes to %q since %s...", table, since.Format(time.RFC3339))
+		chunks, err := saveTableChunks(ctx, table, btClient, store, prefix, bigtable.InfiniteRange(""),
+			bigtable.RowFilter(bigtable.TimestampRangeFilter(since, until)))
+		if err != nil {
+			return fmt.Errorf("failed to save table %q: %s", table, err)
+		}
+
+		priorKeys, err := liveKeys(ctx, parentTarget, table)
+		if err != nil {
+			return fmt.Errorf("failed to compute prior row set for %q: %s", table, err)
+		}
+		tombstones, err := tombstonedRows(ctx, table, btClient, priorKeys)
+		if err != nil {
+			return fmt.Errorf("failed to compute tombstones for %q: %s", table, err)
+		}
+
+		manifest.Tables = append(manifest.Tables, TableManifest{
+			Name:       table,
+			Families:   families,
+			Chunks:     chunks,
+			Tombstones: tombstones,
+		})
+	}
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %s", err)
+	}
+	if err := store.Put(ctx, objectKey(prefix, manifestKey), bytes.NewReader(manifestBytes)); err != nil {
+		return fmt.Errorf("failed to upload manifest: %s", err)
+	}
+	return nil
+}
+
+// RestoreIncremental resolves the chain of snapshots ending at target back to its root full
+// snapshot (following Manifest.Parent), then replays them oldest-first: restoring schema,
+// bulk-applying each increment's cells on top of the last, and finally deleting any tombstoned
+// rows. BigTable's own cell timestamps make replay order-independent for overlapping cells, but
+// tombstones must be applied after the cells of the same increment.
+func RestoreIncremental(ctx context.Context, target string, adminClient *bigtable.AdminClient, btClient *bigtable.Client) error {
+	chain, err := manifestChain(ctx, target)
+	if err != nil {
+		return fmt.Errorf("failed to resolve snapshot chain: %s", err)
+	}
+
+	for i, link := range chain {
+		isRoot := i == 0
+		for _, tm := range link.manifest.Tables {
+			if err := restoreSchema(ctx, adminClient, tm.Name, tm.Families, isRoot); err != nil {
+				return fmt.Errorf("failed to restore schema for %q: %s", tm.Name, err)
+			}
+			if len(tm.Chunks) > 0 {
+				if err := restoreTableChunks(ctx, tm, link.store, btClient); err != nil {
+					return fmt.Errorf("failed to restore table %q: %s", tm.Name, err)
+				}
+			}
+			if len(tm.Tombstones) > 0 {
+				if err := deleteRows(ctx, tm.Name, tm.Tombstones, btClient); err != nil {
+					return fmt.Errorf("failed to apply tombstones for %q: %s", tm.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type manifestLink struct {
+	store    ObjectStore
+	manifest Manifest
+}
+
+// manifestChain follows Manifest.Parent from target back to its root full snapshot, returning
+// the links root-first so callers can replay them in chronological order.
+func manifestChain(ctx context.Context, target string) ([]manifestLink, error) {
+	var chain []manifestLink
+	for target != "" {
+		store, prefix, err := OpenObjectStore(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := readManifest(ctx, store, prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		chain = append(chain, manifestLink{store: store, manifest: manifest})
+		target = manifest.Parent
+	}
+
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, nil
+}
+
+// liveKeys recomputes the set of row keys that were live in table as of target's snapshot, by
+// replaying target's ancestor chain: every cell key seen is added, then each increment's
+// tombstones are removed again. It does not need to talk to BigTable at all.
+func liveKeys(ctx context.Context, target, table string) (map[string]bool, error) {
+	store, prefix, err := OpenObjectStore(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readManifest(ctx, store, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]bool)
+	if manifest.Parent != "" {
+		keys, err = liveKeys(ctx, manifest.Parent, table)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, tm := range manifest.Tables {
+		if tm.Name != table {
+			continue
+		}
+		for _, chunk := range tm.Chunks {
+			cells, err := fetchChunk(ctx, store, chunk)
+			if err != nil {
+				return nil, err
+			}
+			for _, cell := range cells {
+				keys[cell.Key] = true
+			}
+		}
+		for _, k := range tm.Tombstones {
+			delete(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+// tombstonedRows scans table's current row keys and reports which of priorKeys are no longer
+// present, i.e. rows that were deleted since the parent snapshot.
+func tombstonedRows(ctx context.Context, table string, btClient *bigtable.Client, priorKeys map[string]bool) ([]string, error) {
+	if len(priorKeys) == 0 {
+		return nil, nil
+	}
+
+	tbl := btClient.Open(table)
+	seen := make(map[string]bool, len(priorKeys))
+	err := tbl.ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		seen[row.Key()] = true
+		return true
+	}, bigtable.RowFilter(bigtable.ChainFilters(bigtable.StripValueFilter(), bigtable.CellsPerRowLimitFilter(1))))
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan live row keys: %s", err)
+	}
+
+	var tombstones []string
+	for k := range priorKeys {
+		if !seen[k] {
+			tombstones = append(tombstones, k)
+		}
+	}
+	sort.Strings(tombstones)
+	return tombstones, nil
+}
+
+// deleteRows applies a DeleteRow mutation for each of keys in table.
+func deleteRows(ctx context.Context, table string, keys []string, btClient *bigtable.Client) error {
+	tbl := btClient.Open(table)
+
+	muts := make([]*bigtable.Mutation, len(keys))
+	for i := range keys {
+		m := bigtable.NewMutation()
+		m.DeleteRow()
+		muts[i] = m
+	}
+
+	if errs, err := tbl.ApplyBulk(ctx, keys, muts); err != nil {
+		return fmt.Errorf("failed to delete rows: %s", err)
+	} else if errs = filterErrors(errs); len(errs) > 0 {
+		return fmt.Errorf("failed to delete rows, %d errors, first: %s", len(errs), errs[0])
+	}
+	return nil
+}
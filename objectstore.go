@@ -0,0 +1,84 @@
+package bt2disk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ObjectStore is a minimal write/read abstraction over a directory of named blobs; it has no way
+// to list the blobs it holds. It backs
+// the chunked snapshot format (see snapshot.go) across local disk, GCS, and S3, so that format
+// doesn't need to know which one it's talking to.
+type ObjectStore interface {
+	// Put uploads the contents of r as key, replacing anything already stored there.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get opens key for reading. The caller must Close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// OpenObjectStore resolves target - a local directory path, or a gs:// or s3:// URL - into an
+// ObjectStore plus the key prefix snapshot files should be written under.
+func OpenObjectStore(ctx context.Context, target string) (ObjectStore, string, error) {
+	switch {
+	case strings.HasPrefix(target, "gs://"):
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid gs:// target %q: %s", target, err)
+		}
+		store, err := newGCSObjectStore(ctx, u.Host)
+		if err != nil {
+			return nil, "", err
+		}
+		return store, strings.TrimPrefix(u.Path, "/"), nil
+
+	case strings.HasPrefix(target, "s3://"):
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid s3:// target %q: %s", target, err)
+		}
+		store, err := newS3ObjectStore(ctx, u.Host)
+		if err != nil {
+			return nil, "", err
+		}
+		return store, strings.TrimPrefix(u.Path, "/"), nil
+
+	default:
+		return &localObjectStore{root: target}, "", nil
+	}
+}
+
+// localObjectStore writes each key as a file under root, creating parent directories as needed.
+type localObjectStore struct {
+	root string
+}
+
+func (s *localObjectStore) Put(ctx context.Context, key string, r io.Reader) error {
+	p := filepath.Join(s.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory for %q: %s", key, err)
+	}
+
+	f, err := os.Create(p)
+	if err != nil {
+		return fmt.Errorf("failed to create %q: %s", key, err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("failed to write %q: %s", key, err)
+	}
+	return nil
+}
+
+func (s *localObjectStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.root, filepath.FromSlash(key)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %s", key, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,307 @@
+package bt2disk
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// tablesRegistry tracks which Postgres tables in the target database are bt2disk snapshot
+// tables, since (unlike a SQLite file) a Postgres database may hold other, unrelated tables.
+const tablesRegistry = "_bt2disk_tables"
+
+// pgCopySession is one table's in-flight COPY FROM, kept open across WriteCell calls until the
+// table is flushed.
+type pgCopySession struct {
+	tx   *sql.Tx
+	stmt *sql.Stmt
+}
+
+// PostgresStore stores a snapshot as one Postgres table per BigTable table, so that a shared
+// Postgres database can hold backups for a whole team instead of everyone passing .db files
+// around. Cell writes within a table are batched through a COPY FROM for throughput. Each table
+// gets its own copy session, keyed by name under mu, so -parallel-tables can genuinely drive
+// concurrent COPY streams, one per table, instead of serializing on a single shared session.
+type PostgresStore struct {
+	db *sql.DB
+
+	mu     sync.Mutex
+	copies map[string]*pgCopySession
+
+	schemaReady bool
+	metaReady   bool
+}
+
+// OpenPostgresStore opens a connection to the Postgres database identified by dsn.
+func OpenPostgresStore(dsn string) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open postgres dsn: %s", err)
+	}
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %s", err)
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+func pgIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (s *PostgresStore) Close() error {
+	if err := s.flushAllCopies(); err != nil {
+		return err
+	}
+	return s.db.Close()
+}
+
+func (s *PostgresStore) ensureRegistry() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS ` + pgIdent(tablesRegistry) + ` (table_name TEXT PRIMARY KEY)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare table registry: %s", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) ListTables() ([]string, error) {
+	if err := s.ensureRegistry(); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`SELECT table_name FROM ` + pgIdent(tablesRegistry) + ` ORDER BY table_name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %s", err)
+	}
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, fmt.Errorf("failed to scan table name: %s", err)
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+func (s *PostgresStore) BeginTable(table string) error {
+	// COPY holds the connection in a special protocol state, so any pending one for this table
+	// has to be finished before we can issue DDL against it. Other tables' copy sessions are
+	// untouched, so they can keep running concurrently.
+	if err := s.flushTable(table); err != nil {
+		return err
+	}
+	if err := s.ensureRegistry(); err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(`DROP TABLE IF EXISTS ` + pgIdent(table)); err != nil {
+		return fmt.Errorf("failed to drop table: %s", err)
+	}
+	if _, err := s.db.Exec(`CREATE TABLE ` + pgIdent(table) + ` (key TEXT, column_family TEXT, column_name TEXT, value BYTEA, timestamp BIGINT, chk BIGINT)`); err != nil {
+		return fmt.Errorf("failed to create table: %s", err)
+	}
+	if _, err := s.db.Exec(`INSERT INTO `+pgIdent(tablesRegistry)+` (table_name) VALUES ($1) ON CONFLICT (table_name) DO NOTHING`, table); err != nil {
+		return fmt.Errorf("failed to register table: %s", err)
+	}
+	return nil
+}
+
+// flushTable finalizes and commits table's COPY FROM, if one is in flight.
+func (s *PostgresStore) flushTable(table string) error {
+	s.mu.Lock()
+	session, ok := s.copies[table]
+	if ok {
+		delete(s.copies, table)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if _, err := session.stmt.Exec(); err != nil {
+		return fmt.Errorf("failed to finalize COPY for %q: %s", table, err)
+	}
+	if err := session.stmt.Close(); err != nil {
+		return fmt.Errorf("failed to close COPY statement for %q: %s", table, err)
+	}
+	if err := session.tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit COPY transaction for %q: %s", table, err)
+	}
+	return nil
+}
+
+// flushAllCopies finalizes every table's in-flight COPY FROM, if any.
+func (s *PostgresStore) flushAllCopies() error {
+	s.mu.Lock()
+	tables := make([]string, 0, len(s.copies))
+	for table := range s.copies {
+		tables = append(tables, table)
+	}
+	s.mu.Unlock()
+
+	for _, table := range tables {
+		if err := s.flushTable(table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *PostgresStore) WriteCell(table string, cell Cell) error {
+	s.mu.Lock()
+	session, ok := s.copies[table]
+	if !ok {
+		tx, err := s.db.Begin()
+		if err != nil {
+			s.mu.Unlock()
+			return fmt.Errorf("failed to begin COPY transaction: %s", err)
+		}
+		stmt, err := tx.Prepare(pq.CopyIn(table, "key", "column_family", "column_name", "value", "timestamp", "chk"))
+		if err != nil {
+			_ = tx.Rollback()
+			s.mu.Unlock()
+			return fmt.Errorf("failed to prepare COPY for %q: %s", table, err)
+		}
+
+		session = &pgCopySession{tx: tx, stmt: stmt}
+		if s.copies == nil {
+			s.copies = make(map[string]*pgCopySession)
+		}
+		s.copies[table] = session
+	}
+	s.mu.Unlock()
+
+	if _, err := session.stmt.Exec(cell.Key, cell.Family, cell.Column, cell.Value, cell.Timestamp, int64(cell.Checksum)); err != nil {
+		return fmt.Errorf("failed to copy cell: %s", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) ReadCells(table string) (CellIterator, error) {
+	if err := s.flushTable(table); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`SELECT key, column_family, column_name, value, timestamp, chk FROM ` + pgIdent(table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query table contents: %s", err)
+	}
+	return &pgCellIterator{rows: rows}, nil
+}
+
+func (s *PostgresStore) PutSchema(table string, families []familySchema) error {
+	s.mu.Lock()
+	if !s.schemaReady {
+		if _, err := s.db.Exec(`DROP TABLE IF EXISTS ` + pgIdent(schemaTable)); err != nil {
+			s.mu.Unlock()
+			return fmt.Errorf("failed to reset schema table: %s", err)
+		}
+		if _, err := s.db.Exec(`CREATE TABLE ` + pgIdent(schemaTable) + ` (table_name TEXT, family TEXT, gc_policy TEXT)`); err != nil {
+			s.mu.Unlock()
+			return fmt.Errorf("failed to create schema table: %s", err)
+		}
+		s.schemaReady = true
+	}
+	s.mu.Unlock()
+
+	for _, f := range families {
+		if _, err := s.db.Exec(`INSERT INTO `+pgIdent(schemaTable)+` (table_name, family, gc_policy) VALUES ($1, $2, $3)`, table, f.Name, f.GCPolicy); err != nil {
+			return fmt.Errorf("failed to save schema for family %q: %s", f.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *PostgresStore) PutIntegrity(table, root string, rowCount int) error {
+	s.mu.Lock()
+	if !s.metaReady {
+		if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS ` + pgIdent(metaTable) + ` (table_name TEXT PRIMARY KEY, root_hash TEXT, row_count BIGINT)`); err != nil {
+			s.mu.Unlock()
+			return fmt.Errorf("failed to prepare meta table: %s", err)
+		}
+		s.metaReady = true
+	}
+	s.mu.Unlock()
+
+	query := `INSERT INTO ` + pgIdent(metaTable) + ` (table_name, root_hash, row_count) VALUES ($1, $2, $3)
+		ON CONFLICT (table_name) DO UPDATE SET root_hash = EXCLUDED.root_hash, row_count = EXCLUDED.row_count`
+	if _, err := s.db.Exec(query, table, root, rowCount); err != nil {
+		return fmt.Errorf("failed to save integrity metadata for %q: %s", table, err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetIntegrity(table string) (string, int, error) {
+	var exists sql.NullString
+	if err := s.db.QueryRow(`SELECT to_regclass($1)::text`, metaTable).Scan(&exists); err != nil {
+		return "", 0, fmt.Errorf("failed to check for meta table: %s", err)
+	}
+	if !exists.Valid {
+		return "", 0, nil
+	}
+
+	var root string
+	var count int
+	err := s.db.QueryRow(`SELECT root_hash, row_count FROM `+pgIdent(metaTable)+` WHERE table_name = $1`, table).Scan(&root, &count)
+	if err == sql.ErrNoRows {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read integrity metadata for %q: %s", table, err)
+	}
+	return root, count, nil
+}
+
+func (s *PostgresStore) GetSchema() (map[string][]familySchema, error) {
+	schemas := make(map[string][]familySchema)
+
+	var exists sql.NullString
+	if err := s.db.QueryRow(`SELECT to_regclass($1)::text`, schemaTable).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to check for schema table: %s", err)
+	}
+	if !exists.Valid {
+		return schemas, nil
+	}
+
+	rows, err := s.db.Query(`SELECT table_name, family, gc_policy FROM ` + pgIdent(schemaTable))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schema table: %s", err)
+	}
+
+	for rows.Next() {
+		var table string
+		var f familySchema
+		if err := rows.Scan(&table, &f.Name, &f.GCPolicy); err != nil {
+			return nil, fmt.Errorf("failed to scan schema row: %s", err)
+		}
+		schemas[table] = append(schemas[table], f)
+	}
+	return schemas, nil
+}
+
+type pgCellIterator struct {
+	rows *sql.Rows
+	cell Cell
+	err  error
+}
+
+func (i *pgCellIterator) Next() bool {
+	if !i.rows.Next() {
+		return false
+	}
+	var chk int64
+	if err := i.rows.Scan(&i.cell.Key, &i.cell.Family, &i.cell.Column, &i.cell.Value, &i.cell.Timestamp, &chk); err != nil {
+		i.err = fmt.Errorf("failed to scan cell: %s", err)
+		return false
+	}
+	i.cell.Checksum = uint32(chk)
+	return true
+}
+
+func (i *pgCellIterator) Cell() Cell   { return i.cell }
+func (i *pgCellIterator) Err() error   { return i.err }
+func (i *pgCellIterator) Close() error { return i.rows.Close() }
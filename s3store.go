@@ -0,0 +1,55 @@
+package bt2disk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3ObjectStore stores blobs as objects in a single S3 bucket.
+type s3ObjectStore struct {
+	client *s3.Client
+	bucket string
+}
+
+func newS3ObjectStore(ctx context.Context, bucket string) (*s3ObjectStore, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %s", err)
+	}
+	return &s3ObjectStore{client: s3.NewFromConfig(cfg), bucket: bucket}, nil
+}
+
+func (s *s3ObjectStore) Put(ctx context.Context, key string, r io.Reader) error {
+	// the S3 API needs to know the body length up front, so buffer the (already chunk-sized)
+	// payload rather than streaming it
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to buffer %q: %s", key, err)
+	}
+
+	if _, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	}); err != nil {
+		return fmt.Errorf("failed to upload %q: %s", key, err)
+	}
+	return nil
+}
+
+func (s *s3ObjectStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %q: %s", key, err)
+	}
+	return out.Body, nil
+}
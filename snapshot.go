@@ -0,0 +1,493 @@
+package bt2disk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// manifestKey is the well-known name of the manifest file at the root of every chunked snapshot.
+const manifestKey = "manifest.json"
+
+// maxChunkBytes bounds the amount of uncompressed cell data written to a single chunk file
+// before it's flushed and a new one is started.
+const maxChunkBytes = 64 << 20 // 64MiB
+
+// Manifest describes a chunked snapshot written by SaveObjectSnapshot or SaveIncremental: every
+// table it covers, that table's column families/GC policies, and the chunk files holding its
+// cells. Until is set on every snapshot, full or incremental, as the watermark a later
+// SaveIncremental should read forward from; Parent/Since are only set for an incremental snapshot
+// (see SaveIncremental).
+type Manifest struct {
+	Tables []TableManifest `json:"tables"`
+
+	Parent string `json:"parent,omitempty"` // target of the snapshot this one is relative to
+	Since  int64  `json:"since,omitempty"`   // unix nanos; inclusive lower bound on cell timestamps
+	Until  int64  `json:"until,omitempty"`   // unix nanos; exclusive upper bound on cell timestamps
+}
+
+// TableManifest is one BigTable table's worth of a Manifest.
+type TableManifest struct {
+	Name     string         `json:"name"`
+	Families []familySchema `json:"families"`
+	Chunks   []ChunkInfo    `json:"chunks"`
+
+	// Tombstones lists rows that were present as of the parent snapshot but were no longer
+	// observed in BigTable as of this one, so RestoreIncremental can mirror their deletion.
+	Tombstones []string `json:"tombstones,omitempty"`
+}
+
+// ChunkInfo locates and authenticates a single chunk file within a TableManifest.
+type ChunkInfo struct {
+	Path      string `json:"path"`
+	SHA256    string `json:"sha256"`
+	CellCount int    `json:"cell_count"`
+}
+
+// SaveObjectSnapshot writes every BigTable table reachable via adminClient/btClient to target (a
+// local directory, or a gs:// or s3:// URL) as a directory of zstd-compressed, row-range-chunked
+// files plus a manifest.json describing them.
+func SaveObjectSnapshot(ctx context.Context, target string, adminClient *bigtable.AdminClient, btClient *bigtable.Client) error {
+	started := time.Now()
+
+	store, prefix, err := OpenObjectStore(ctx, target)
+	if err != nil {
+		return fmt.Errorf("failed to open object store: %s", err)
+	}
+
+	tables, err := adminClient.Tables(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list BT tables: %s", err)
+	}
+	sort.Strings(tables)
+
+	manifest := Manifest{Until: started.UnixNano()}
+	for _, table := range tables {
+		info, err := adminClient.TableInfo(ctx, table)
+		if err != nil {
+			return fmt.Errorf("failed to fetch table info for %q: %s", table, err)
+		}
+		families := make([]familySchema, len(info.FamilyInfos))
+		for i, fi := range info.FamilyInfos {
+			families[i] = familySchema{Name: fi.Name, GCPolicy: fi.GCPolicy}
+		}
+
+		log.Printf("saving %q table to object storage...", table)
+		chunks, err := saveTableChunks(ctx, table, btClient, store, prefix, bigtable.InfiniteRange(""))
+		if err != nil {
+			return fmt.Errorf("failed to save table %q: %s", table, err)
+		}
+		log.Printf("saved %q as %d chunk(s)", table, len(chunks))
+
+		manifest.Tables = append(manifest.Tables, TableManifest{Name: table, Families: families, Chunks: chunks})
+	}
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %s", err)
+	}
+	if err := store.Put(ctx, objectKey(prefix, manifestKey), bytes.NewReader(manifestBytes)); err != nil {
+		return fmt.Errorf("failed to upload manifest: %s", err)
+	}
+	return nil
+}
+
+// saveTableChunks streams the cells of table matched by rr/opts through a protobuf encoder into
+// size-bounded, zstd compressed chunk files, uploading each as it fills.
+func saveTableChunks(ctx context.Context, table string, btClient *bigtable.Client, store ObjectStore, prefix string, rr bigtable.RowSet, opts ...bigtable.ReadOption) ([]ChunkInfo, error) {
+	var (
+		chunks   []ChunkInfo
+		buf      bytes.Buffer
+		count    int
+		chunkNum int
+	)
+
+	flush := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+
+		compressed, sum, err := compressChunk(buf.Bytes())
+		if err != nil {
+			return err
+		}
+
+		path := objectKey(prefix, fmt.Sprintf("tables/%s/part-%05d.pb.zst", table, chunkNum))
+		if err := store.Put(ctx, path, bytes.NewReader(compressed)); err != nil {
+			return fmt.Errorf("failed to upload chunk %q: %s", path, err)
+		}
+
+		chunks = append(chunks, ChunkInfo{Path: path, SHA256: sum, CellCount: count})
+		chunkNum++
+		buf.Reset()
+		count = 0
+		return nil
+	}
+
+	tbl := btClient.Open(table)
+	var rowErr error
+	err := tbl.ReadRows(ctx, rr, func(row bigtable.Row) bool {
+		for cf, items := range row {
+			for _, item := range items {
+				// tricky!  the item.Column that we get back is prefixed with the column family
+				col := strings.TrimPrefix(item.Column, cf+":")
+				timestamp := item.Timestamp.Time()
+
+				hasher := fnv.New32a()
+				_, _ = fmt.Fprintf(hasher, item.Row)
+				_, _ = fmt.Fprintf(hasher, cf)
+				_, _ = fmt.Fprintf(hasher, col)
+				_, _ = hasher.Write(item.Value)
+				_, _ = fmt.Fprintf(hasher, timestamp.Format(time.RFC3339Nano))
+
+				cell := Cell{
+					Key:       item.Row,
+					Family:    cf,
+					Column:    col,
+					Value:     item.Value,
+					Timestamp: timestamp.UnixNano(),
+					Checksum:  hasher.Sum32(),
+				}
+
+				writeFramedCell(&buf, cell)
+				count++
+
+				if buf.Len() >= maxChunkBytes {
+					if err := flush(); err != nil {
+						rowErr = err
+						return false
+					}
+				}
+			}
+		}
+		return true
+	}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failure while iterating rows: %s", err)
+	}
+	if rowErr != nil {
+		return nil, rowErr
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+// RestoreObjectSnapshot reads the manifest and chunk files written by SaveObjectSnapshot from
+// target and restores each table's schema and cells, fetching a table's chunks in parallel.
+func RestoreObjectSnapshot(ctx context.Context, target string, adminClient *bigtable.AdminClient, btClient *bigtable.Client) error {
+	store, prefix, err := OpenObjectStore(ctx, target)
+	if err != nil {
+		return fmt.Errorf("failed to open object store: %s", err)
+	}
+
+	manifest, err := readManifest(ctx, store, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, tm := range manifest.Tables {
+		if err := restoreSchema(ctx, adminClient, tm.Name, tm.Families, true); err != nil {
+			return fmt.Errorf("failed to restore schema for %q: %s", tm.Name, err)
+		}
+		if err := restoreTableChunks(ctx, tm, store, btClient); err != nil {
+			return fmt.Errorf("failed to restore table %q: %s", tm.Name, err)
+		}
+	}
+	return nil
+}
+
+// readManifest fetches and parses the manifest.json stored under prefix in store.
+func readManifest(ctx context.Context, store ObjectStore, prefix string) (Manifest, error) {
+	r, err := store.Get(ctx, objectKey(prefix, manifestKey))
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to fetch manifest: %s", err)
+	}
+	defer r.Close()
+
+	var manifest Manifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return Manifest{}, fmt.Errorf("failed to parse manifest: %s", err)
+	}
+	return manifest, nil
+}
+
+// restoreTableChunks fetches every chunk of tm in parallel - each is an independent row-range,
+// so the dominant cost of a restore (object-store round trips) parallelizes cleanly - then
+// bulk-applies the cells they contain in chunk order.
+func restoreTableChunks(ctx context.Context, tm TableManifest, store ObjectStore, btClient *bigtable.Client) error {
+	tbl := btClient.Open(tm.Name)
+
+	type result struct {
+		cells []Cell
+		err   error
+	}
+	results := make([]result, len(tm.Chunks))
+
+	var wg sync.WaitGroup
+	for i, chunk := range tm.Chunks {
+		wg.Add(1)
+		go func(i int, chunk ChunkInfo) {
+			defer wg.Done()
+			cells, err := fetchChunk(ctx, store, chunk)
+			results[i] = result{cells: cells, err: err}
+		}(i, chunk)
+	}
+	wg.Wait()
+
+	var c int
+	var keys []string
+	var muts []*bigtable.Mutation
+	for _, res := range results {
+		if res.err != nil {
+			return res.err
+		}
+
+		for _, cell := range res.cells {
+			timestamp := time.Unix(0, cell.Timestamp)
+
+			hasher := fnv.New32a()
+			_, _ = fmt.Fprintf(hasher, cell.Key)
+			_, _ = fmt.Fprintf(hasher, cell.Family)
+			_, _ = fmt.Fprintf(hasher, cell.Column)
+			_, _ = hasher.Write(cell.Value)
+			_, _ = fmt.Fprintf(hasher, timestamp.Format(time.RFC3339Nano))
+
+			if computed := hasher.Sum32(); cell.Checksum != computed {
+				return fmt.Errorf("integrity check failed, saved chk=%d, computed hash = %d", cell.Checksum, computed)
+			}
+
+			m := bigtable.NewMutation()
+			m.Set(cell.Family, cell.Column, bigtable.Time(timestamp), cell.Value)
+
+			c++
+			keys = append(keys, cell.Key)
+			muts = append(muts, m)
+
+			if len(muts) == 100 {
+				if err := applyBulk(ctx, tbl, keys, muts); err != nil {
+					return err
+				}
+				keys, muts = nil, nil
+			}
+		}
+	}
+
+	if len(muts) > 0 {
+		if err := applyBulk(ctx, tbl, keys, muts); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("restored %d rows for %s", c, tm.Name)
+	return nil
+}
+
+func applyBulk(ctx context.Context, tbl *bigtable.Table, keys []string, muts []*bigtable.Mutation) error {
+	if errs, err := tbl.ApplyBulk(ctx, keys, muts); err != nil {
+		return fmt.Errorf("failed to write to bigtable: %s", err)
+	} else if errs = filterErrors(errs); len(errs) > 0 {
+		return fmt.Errorf("failed to write to bigtable, %d errors, first: %s", len(errs), errs[0])
+	}
+	return nil
+}
+
+// fetchChunk downloads chunk, verifies its SHA-256 against the manifest, and decodes its cells.
+func fetchChunk(ctx context.Context, store ObjectStore, chunk ChunkInfo) ([]Cell, error) {
+	r, err := store.Get(ctx, chunk.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch chunk %q: %s", chunk.Path, err)
+	}
+	defer r.Close()
+
+	compressed, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %q: %s", chunk.Path, err)
+	}
+
+	sum := sha256.Sum256(compressed)
+	if got := hex.EncodeToString(sum[:]); got != chunk.SHA256 {
+		return nil, fmt.Errorf("chunk %q failed integrity check, manifest sha256=%s, computed=%s", chunk.Path, chunk.SHA256, got)
+	}
+
+	zr, err := zstd.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zstd reader for %q: %s", chunk.Path, err)
+	}
+	defer zr.Close()
+
+	cells := make([]Cell, 0, chunk.CellCount)
+	br := bufio.NewReader(zr)
+	for {
+		cell, err := readFramedCell(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode chunk %q: %s", chunk.Path, err)
+		}
+		cells = append(cells, cell)
+	}
+	return cells, nil
+}
+
+func compressChunk(data []byte) (compressed []byte, sha256Hex string, err error) {
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create zstd writer: %s", err)
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, "", fmt.Errorf("failed to compress chunk: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, "", fmt.Errorf("failed to finalize chunk compression: %s", err)
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	return buf.Bytes(), hex.EncodeToString(sum[:]), nil
+}
+
+func objectKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "/" + key
+}
+
+// writeFramedCell appends cell to buf as a protobuf message (see encodeCell), prefixed with its
+// varint-encoded length so a chunk can hold many cells back to back and be read as a stream.
+func writeFramedCell(buf *bytes.Buffer, cell Cell) {
+	msg := encodeCell(cell)
+
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(msg)))
+	buf.Write(lenBuf[:n])
+	buf.Write(msg)
+}
+
+// readFramedCell reads one length-prefixed cell written by writeFramedCell, returning io.EOF
+// once br is exhausted between frames.
+func readFramedCell(br *bufio.Reader) (Cell, error) {
+	length, err := binary.ReadUvarint(br)
+	if err != nil {
+		if err == io.EOF {
+			return Cell{}, io.EOF
+		}
+		return Cell{}, fmt.Errorf("failed to read cell length: %s", err)
+	}
+
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(br, msg); err != nil {
+		return Cell{}, fmt.Errorf("failed to read cell body: %s", err)
+	}
+	return decodeCell(msg)
+}
+
+// encodeCell writes cell as a small hand-rolled protobuf message (one per cell, field numbers
+// below), using the low-level protowire package directly rather than generating code for what
+// is, for now, a single message type:
+//
+//	1: key       (bytes)
+//	2: family    (bytes)
+//	3: column    (bytes)
+//	4: value     (bytes)
+//	5: timestamp (varint, unix nanos)
+//	6: checksum  (varint)
+func encodeCell(cell Cell) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, cell.Key)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, cell.Family)
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendString(b, cell.Column)
+	b = protowire.AppendTag(b, 4, protowire.BytesType)
+	b = protowire.AppendBytes(b, cell.Value)
+	b = protowire.AppendTag(b, 5, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(cell.Timestamp))
+	b = protowire.AppendTag(b, 6, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(cell.Checksum))
+	return b
+}
+
+func decodeCell(b []byte) (Cell, error) {
+	var cell Cell
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return Cell{}, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch num {
+		case 1:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return Cell{}, protowire.ParseError(n)
+			}
+			cell.Key = v
+			b = b[n:]
+		case 2:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return Cell{}, protowire.ParseError(n)
+			}
+			cell.Family = v
+			b = b[n:]
+		case 3:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return Cell{}, protowire.ParseError(n)
+			}
+			cell.Column = v
+			b = b[n:]
+		case 4:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return Cell{}, protowire.ParseError(n)
+			}
+			cell.Value = append([]byte(nil), v...)
+			b = b[n:]
+		case 5:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return Cell{}, protowire.ParseError(n)
+			}
+			cell.Timestamp = int64(v)
+			b = b[n:]
+		case 6:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return Cell{}, protowire.ParseError(n)
+			}
+			cell.Checksum = uint32(v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return Cell{}, protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return cell, nil
+}
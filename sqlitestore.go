@@ -0,0 +1,242 @@
+package bt2disk
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// metaTable holds the per-table integrity rollup (root hash and row count) recorded by
+// PutIntegrity, so RestoreTable can verify a snapshot was replayed back intact.
+const metaTable = "_bt2disk_meta"
+
+// SQLiteStore is the original bt2disk snapshot format: one SQLite table per BigTable table,
+// named after it, plus a schemaTable tracking column families and GC policies. SQLite doesn't
+// tolerate concurrent writers well, so every method that writes to the database takes mu, meaning
+// -parallel-tables serializes SQLite writes regardless of its setting; the concurrency it buys
+// comes from overlapping BigTable reads, not from the local write path.
+type SQLiteStore struct {
+	db      *sql.DB
+	inserts map[string]*sql.Stmt
+
+	mu          sync.Mutex
+	schemaReady bool
+	metaReady   bool
+}
+
+// OpenSQLiteStore opens (creating if necessary) the SQLite database at path.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %s", path, err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) ListTables() ([]string, error) {
+	rows, err := s.db.Query(`SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' AND name != '` + schemaTable + `' AND name != '` + metaTable + `'`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sqlite for list of tables: %s", err)
+	}
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, fmt.Errorf("failed to scan table-list results: %s", err)
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+func (s *SQLiteStore) BeginTable(table string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.db.Exec(`DROP TABLE IF EXISTS "` + table + `"`); err != nil {
+		return fmt.Errorf("failed to execute DROP TABLE: %s", err)
+	}
+	if _, err := s.db.Exec(`CREATE TABLE "` + table + `" (key TEXT, column_family TEXT, column TEXT, value BLOB, timestamp INTEGER, chk INTEGER)`); err != nil {
+		return fmt.Errorf("failed to execute CREATE TABLE: %s", err)
+	}
+	// a fresh table needs a fresh prepared INSERT, in case this table was saved earlier in the
+	// same process (e.g. a retried save)
+	if s.inserts != nil {
+		delete(s.inserts, table)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) insertStmt(table string) (*sql.Stmt, error) {
+	if stmt, ok := s.inserts[table]; ok {
+		return stmt, nil
+	}
+
+	stmt, err := s.db.Prepare(`INSERT INTO "` + table + `" VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare INSERT: %s", err)
+	}
+
+	if s.inserts == nil {
+		s.inserts = make(map[string]*sql.Stmt)
+	}
+	s.inserts[table] = stmt
+	return stmt, nil
+}
+
+func (s *SQLiteStore) WriteCell(table string, cell Cell) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stmt, err := s.insertStmt(table)
+	if err != nil {
+		return err
+	}
+	if _, err := stmt.Exec(cell.Key, cell.Family, cell.Column, cell.Value, cell.Timestamp, cell.Checksum); err != nil {
+		return fmt.Errorf("failed to insert cell: %s", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) ReadCells(table string) (CellIterator, error) {
+	rows, err := s.db.Query(`SELECT key, column_family, column, value, timestamp, chk FROM "` + table + `"`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query table contents: %s", err)
+	}
+	return &sqliteCellIterator{rows: rows}, nil
+}
+
+func (s *SQLiteStore) PutSchema(table string, families []familySchema) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.schemaReady {
+		if err := createSchemaTable(s.db); err != nil {
+			return err
+		}
+		s.schemaReady = true
+	}
+
+	insertStmt, err := s.db.Prepare(`INSERT INTO "` + schemaTable + `" VALUES (?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare schema INSERT: %s", err)
+	}
+
+	for _, f := range families {
+		if _, err := insertStmt.Exec(table, f.Name, f.GCPolicy); err != nil {
+			return fmt.Errorf("failed to save schema for family %q: %s", f.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) GetSchema() (map[string][]familySchema, error) {
+	schemas := make(map[string][]familySchema)
+
+	var exists string
+	if err := s.db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name = '` + schemaTable + `'`).Scan(&exists); err != nil {
+		if err == sql.ErrNoRows {
+			return schemas, nil
+		}
+		return nil, fmt.Errorf("failed to check for schema table: %s", err)
+	}
+
+	rows, err := s.db.Query(`SELECT table_name, family, gc_policy FROM "` + schemaTable + `"`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schema table: %s", err)
+	}
+
+	for rows.Next() {
+		var table string
+		var f familySchema
+		if err := rows.Scan(&table, &f.Name, &f.GCPolicy); err != nil {
+			return nil, fmt.Errorf("failed to scan schema row: %s", err)
+		}
+		schemas[table] = append(schemas[table], f)
+	}
+	return schemas, nil
+}
+
+func (s *SQLiteStore) PutIntegrity(table, root string, rowCount int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.metaReady {
+		if _, err := s.db.Exec(`DROP TABLE IF EXISTS "` + metaTable + `"`); err != nil {
+			return fmt.Errorf("failed to reset meta table: %s", err)
+		}
+		if _, err := s.db.Exec(`CREATE TABLE "` + metaTable + `" (table_name TEXT PRIMARY KEY, root_hash TEXT, row_count INTEGER)`); err != nil {
+			return fmt.Errorf("failed to create meta table: %s", err)
+		}
+		s.metaReady = true
+	}
+
+	if _, err := s.db.Exec(`INSERT INTO "`+metaTable+`" VALUES (?, ?, ?)`, table, root, rowCount); err != nil {
+		return fmt.Errorf("failed to save integrity metadata for %q: %s", table, err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) GetIntegrity(table string) (string, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var exists string
+	if err := s.db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name = '` + metaTable + `'`).Scan(&exists); err != nil {
+		if err == sql.ErrNoRows {
+			return "", 0, nil
+		}
+		return "", 0, fmt.Errorf("failed to check for meta table: %s", err)
+	}
+
+	var root string
+	var count int
+	err := s.db.QueryRow(`SELECT root_hash, row_count FROM "`+metaTable+`" WHERE table_name = ?`, table).Scan(&root, &count)
+	if err == sql.ErrNoRows {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read integrity metadata for %q: %s", table, err)
+	}
+	return root, count, nil
+}
+
+// createSchemaTable (re)creates the metadata table that records each BigTable table's column
+// families and GC policies, so the snapshot can be used to rebuild tables from scratch.
+func createSchemaTable(db *sql.DB) error {
+	if _, err := db.Exec(`DROP TABLE IF EXISTS "` + schemaTable + `"`); err != nil {
+		return fmt.Errorf("failed to execute DROP TABLE: %s", err)
+	}
+	if _, err := db.Exec(`CREATE TABLE "` + schemaTable + `" (table_name TEXT, family TEXT, gc_policy TEXT)`); err != nil {
+		return fmt.Errorf("failed to execute CREATE TABLE: %s", err)
+	}
+	return nil
+}
+
+type sqliteCellIterator struct {
+	rows *sql.Rows
+	cell Cell
+	err  error
+}
+
+func (i *sqliteCellIterator) Next() bool {
+	if !i.rows.Next() {
+		return false
+	}
+	if err := i.rows.Scan(&i.cell.Key, &i.cell.Family, &i.cell.Column, &i.cell.Value, &i.cell.Timestamp, &i.cell.Checksum); err != nil {
+		i.err = fmt.Errorf("failed to scan cell: %s", err)
+		return false
+	}
+	return true
+}
+
+func (i *sqliteCellIterator) Cell() Cell   { return i.cell }
+func (i *sqliteCellIterator) Err() error   { return i.err }
+func (i *sqliteCellIterator) Close() error { return i.rows.Close() }
@@ -0,0 +1,53 @@
+package bt2disk
+
+// Cell is a single BigTable cell as persisted by a Store.
+type Cell struct {
+	Key       string
+	Family    string
+	Column    string
+	Value     []byte
+	Timestamp int64 // unix nanos
+	Checksum  uint32
+}
+
+// CellIterator walks the cells saved for a single table, in the order the Store returns them.
+type CellIterator interface {
+	// Next advances the iterator and reports whether a cell is available via Cell.
+	Next() bool
+	// Cell returns the cell most recently advanced to by Next.
+	Cell() Cell
+	// Err returns the first error encountered while iterating, if any.
+	Err() error
+	// Close releases resources held by the iterator.
+	Close() error
+}
+
+// Store is the persistence backend behind Save/Restore. It holds one snapshot's worth of table
+// schemas and cells, independent of where that snapshot actually lives - a local SQLite file, a
+// shared Postgres database, or anything else that can satisfy this interface.
+type Store interface {
+	// ListTables returns the names of the BigTable tables present in the snapshot.
+	ListTables() ([]string, error)
+	// BeginTable (re)creates an empty destination for table's cells, discarding anything
+	// previously saved for it, ready for a sequence of WriteCell calls.
+	BeginTable(table string) error
+	// WriteCell appends a single cell to table, which must already have been passed to
+	// BeginTable earlier in this save.
+	WriteCell(table string, cell Cell) error
+	// ReadCells returns an iterator over every cell saved for table. The caller must Close it.
+	ReadCells(table string) (CellIterator, error)
+	// PutSchema records table's column families and GC policies.
+	PutSchema(table string, families []familySchema) error
+	// GetSchema returns the saved column families and GC policies, keyed by table name. It
+	// returns an empty map, not an error, for a snapshot saved before schemas were tracked.
+	GetSchema() (map[string][]familySchema, error)
+	// PutIntegrity records the SHA-256 rollup root hash and row count computed over every cell
+	// written to table, so RestoreTable can verify it was replayed back intact.
+	PutIntegrity(table string, root string, rowCount int) error
+	// GetIntegrity returns the root hash and row count PutIntegrity saved for table. It returns
+	// ("", 0, nil), not an error, for a snapshot saved before integrity tracking existed.
+	GetIntegrity(table string) (root string, rowCount int, err error)
+	// Close releases any resources (connections, file handles, in-flight transactions) held by
+	// the store.
+	Close() error
+}